@@ -4,13 +4,14 @@ import (
 	"context"
 	"fmt"
 	"sync"
-	"time"
 
 	"github.com/gogo/protobuf/proto"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/protocol"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
 )
 
 var log = logging.Logger("libp2pclient")
@@ -18,13 +19,24 @@ var log = logging.Logger("libp2pclient")
 // Client Libp2pclient is responsible for sending
 // requests to other peers.
 type Client struct {
-	ctx  context.Context
-	host host.Host
-	self peer.ID
+	ctx    context.Context
+	cancel context.CancelFunc
+	host   host.Host
+	self   peer.ID
+
+	// group owns every background goroutine started on this Client's
+	// behalf (the idle reaper and the per-peer reader, writer and
+	// keepalive ping goroutines); Close waits on it.
+	group *errgroup.Group
+
+	closeOnce sync.Once
+	closed    chan struct{}
 
 	sendersLock sync.Mutex
 	peerSenders map[peer.ID]*peerMessageSender
 	protocols   []protocol.ID
+
+	cfg clientConfig
 }
 
 // DecodeResponseFunc is a function that is passed into this generic libp2p
@@ -33,31 +45,59 @@ type Client struct {
 // only know to a specific libp2p client using this generic client.
 type DecodeResponseFunc func([]byte) error
 
-// Timeout to wait for a response after a request is sent
-var readMessageTimeout = 10 * time.Second
-
-// ErrReadTimeout is an error that occurs when no message is read within the timeout period.
-var ErrReadTimeout = fmt.Errorf("timed out reading response")
+// NewClient creates a new libp2pclient Client. protoIDs is an ordered
+// preference list, newest first: when opening a stream to a peer, libp2p
+// multistream-negotiates the first entry the remote also supports, so
+// callers can add a new protocol version while still falling back to an
+// older one for peers that haven't upgraded yet. Use
+// Client.NegotiatedProtocol to see which one a given peer ended up on.
+func NewClient(ctx context.Context, h host.Host, protoIDs []protocol.ID, options ...ClientOption) (*Client, error) {
+	if len(protoIDs) == 0 {
+		return nil, fmt.Errorf("at least one protocol.ID is required")
+	}
 
-// NewClient creates a new libp2pclient Client
-func NewClient(ctx context.Context, h host.Host, protoID protocol.ID, options ...ClientOption) (*Client, error) {
 	var cfg clientConfig
 	if err := cfg.apply(options...); err != nil {
 		return nil, err
 	}
 
-	// Start a client
-	return &Client{
-		ctx:         ctx,
+	clientCtx, cancel := context.WithCancel(ctx)
+	group, groupCtx := errgroup.WithContext(clientCtx)
+
+	c := &Client{
+		ctx:         groupCtx,
+		cancel:      cancel,
+		group:       group,
+		closed:      make(chan struct{}),
 		host:        h,
 		self:        h.ID(),
 		peerSenders: make(map[peer.ID]*peerMessageSender),
-		protocols:   []protocol.ID{protoID},
-	}, nil
+		protocols:   append([]protocol.ID(nil), protoIDs...),
+		cfg:         cfg,
+	}
+
+	if cfg.registerer != nil {
+		if err := cfg.registerer.Register(newPromCollector(c)); err != nil {
+			return nil, fmt.Errorf("registering libp2pclient metrics: %w", err)
+		}
+	}
+
+	group.Go(func() error {
+		c.idleReapLoop(cfg.idleTimeout)
+		return nil
+	})
+
+	return c, nil
 }
 
 // SendRequest sends out a request
 func (c *Client) SendRequest(ctx context.Context, p peer.ID, msg proto.Message, decodeRsp DecodeResponseFunc) error {
+	select {
+	case <-c.closed:
+		return ErrClientClosed
+	default:
+	}
+
 	sender, err := c.messageSenderForPeer(ctx, p)
 	if err != nil {
 		log.Debugw("request failed to open message sender", "error", err, "to", p)
@@ -69,13 +109,30 @@ func (c *Client) SendRequest(ctx context.Context, p peer.ID, msg proto.Message,
 
 // SendMessage sends out a message
 func (c *Client) SendMessage(ctx context.Context, p peer.ID, msg proto.Message) error {
+	return c.sendMessage(ctx, p, msg, false)
+}
+
+// SendPriorityMessage sends out a message ahead of any bulk traffic already
+// queued for p, for control messages that shouldn't get stuck behind a busy
+// writer. It otherwise behaves exactly like SendMessage.
+func (c *Client) SendPriorityMessage(ctx context.Context, p peer.ID, msg proto.Message) error {
+	return c.sendMessage(ctx, p, msg, true)
+}
+
+func (c *Client) sendMessage(ctx context.Context, p peer.ID, msg proto.Message, direct bool) error {
+	select {
+	case <-c.closed:
+		return ErrClientClosed
+	default:
+	}
+
 	sender, err := c.messageSenderForPeer(ctx, p)
 	if err != nil {
 		log.Debugw("message failed to open message sender", "error", err, "to", p)
 		return err
 	}
 
-	if err = sender.sendMessage(ctx, msg, c.host, c.protocols); err != nil {
+	if err = sender.sendMessage(ctx, msg, c.host, c.protocols, direct); err != nil {
 		log.Debugw("message failed", "error", err, "to", p)
 		return err
 	}
@@ -83,6 +140,20 @@ func (c *Client) SendMessage(ctx context.Context, p peer.ID, msg proto.Message)
 	return nil
 }
 
+// NegotiatedProtocol returns the protocol.ID that was most recently
+// multistream-negotiated with p, and false if no stream to p has been opened
+// yet (or p's sender has since been reaped or closed). The value is kept
+// after a stream breaks, until a reopened stream negotiates a new one.
+func (c *Client) NegotiatedProtocol(p peer.ID) (protocol.ID, bool) {
+	c.sendersLock.Lock()
+	ms, ok := c.peerSenders[p]
+	c.sendersLock.Unlock()
+	if !ok {
+		return "", false
+	}
+	return ms.negotiatedProtocol()
+}
+
 func (c *Client) peerSender(peerID peer.ID) *peerMessageSender {
 	c.sendersLock.Lock()
 	defer c.sendersLock.Unlock()
@@ -92,33 +163,44 @@ func (c *Client) peerSender(peerID peer.ID) *peerMessageSender {
 		return ms
 	}
 	ms = &peerMessageSender{
-		peerID:  peerID,
-		ctxLock: newCtxMutex(),
+		peerID:            peerID,
+		invalid:           true,
+		ctxLock:           newCtxMutex(),
+		pendingRequestCap: c.cfg.pendingRequestCap,
+		metrics:           &PeerMetric{},
+		limiter:           newRateLimiter(c.cfg.rateLimit, c.cfg.rateBurst),
+		group:             c.group,
+		clientCtx:         c.ctx,
+		pingInterval:      c.cfg.pingInterval,
+		maxMissedPings:    c.cfg.maxMissedPings,
 	}
+	ms.touch()
 	c.peerSenders[peerID] = ms
 	return ms
 }
 
+// newRateLimiter returns a token-bucket limiter configured by RateLimit, or
+// nil if no limit was configured (rps <= 0).
+func newRateLimiter(rps float64, burst int) *rate.Limiter {
+	if rps <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(rps), burst)
+}
+
+// messageSenderForPeer returns the peerMessageSender for peerID, opening its
+// stream if necessary. The sender stays in peerSenders even when prep fails
+// or the stream later breaks, so it can be reopened and keep accumulating
+// its PeerMetric on the next call instead of starting over from a fresh
+// sender; only the idle reaper and Client.Close actually discard one.
 func (c *Client) messageSenderForPeer(ctx context.Context, peerID peer.ID) (*peerMessageSender, error) {
 	ms := c.peerSender(peerID)
 
 	if err := ms.prepOrInvalidate(ctx, c.host, c.protocols); err != nil {
-		c.sendersLock.Lock()
-		defer c.sendersLock.Unlock()
-
-		if msCur, ok := c.peerSenders[peerID]; ok {
-			// Changed. Use the new one, old one is invalid and
-			// not in the map so we can just throw it away.
-			if ms != msCur {
-				return msCur, nil
-			}
-			// Not changed, remove the now invalid stream from the
-			// map.
-			delete(c.peerSenders, peerID)
-		}
-		// Invalid but not in map. Must have been removed by a disconnect.
 		return nil, err
 	}
-	// All ready to go.
 	return ms, nil
 }
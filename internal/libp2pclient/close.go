@@ -0,0 +1,46 @@
+package libp2pclient
+
+import (
+	"context"
+	"errors"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// ErrClientClosed is returned by SendRequest/SendMessage, and delivered to
+// any request waiting on a response, once Close has been called.
+var ErrClientClosed = errors.New("libp2pclient: client closed")
+
+// Close cancels the Client's background context, closes every outstanding
+// peer stream (flushing anything already queued first, so peers see a
+// clean stream close rather than a reset), and fails any in-flight
+// SendRequest with ErrClientClosed. It then waits for the reader/writer
+// goroutines to exit, bounded by ctx.
+func (c *Client) Close(ctx context.Context) error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.cancel()
+
+		c.sendersLock.Lock()
+		senders := make([]*peerMessageSender, 0, len(c.peerSenders))
+		for _, ms := range c.peerSenders {
+			senders = append(senders, ms)
+		}
+		c.peerSenders = make(map[peer.ID]*peerMessageSender)
+		c.sendersLock.Unlock()
+
+		for _, ms := range senders {
+			ms.close(ErrClientClosed)
+		}
+	})
+
+	done := make(chan error, 1)
+	go func() { done <- c.group.Wait() }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,26 @@
+package libp2pclient
+
+import "context"
+
+// ctxMutex is a mutex that can be acquired with a context, so that a caller
+// waiting for the lock can give up if its context is canceled.
+type ctxMutex chan struct{}
+
+func newCtxMutex() ctxMutex {
+	return make(ctxMutex, 1)
+}
+
+// Lock acquires the mutex, returning ctx.Err() if ctx is done before the
+// mutex becomes available.
+func (m ctxMutex) Lock(ctx context.Context) error {
+	select {
+	case m <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m ctxMutex) Unlock() {
+	<-m
+}
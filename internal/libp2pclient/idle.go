@@ -0,0 +1,50 @@
+package libp2pclient
+
+import "time"
+
+// idleReapInterval is how often the idle reaper checks peerSenders against
+// IdleTimeout. It is independent of IdleTimeout itself so a long timeout
+// doesn't also mean a long, coarse reaping granularity.
+const idleReapInterval = time.Minute
+
+// idleReapLoop runs as a Client-scoped background goroutine, evicting
+// streams to peers that haven't been touched in idleTimeout so peerSenders
+// doesn't grow unboundedly for every peer ever contacted.
+func (c *Client) idleReapLoop(idleTimeout time.Duration) {
+	if idleTimeout <= 0 {
+		return
+	}
+
+	interval := idleReapInterval
+	if idleTimeout < interval {
+		interval = idleTimeout
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			c.reapIdlePeers(idleTimeout)
+		}
+	}
+}
+
+func (c *Client) reapIdlePeers(idleTimeout time.Duration) {
+	c.sendersLock.Lock()
+	var stale []*peerMessageSender
+	for p, ms := range c.peerSenders {
+		if ms.idleFor() >= idleTimeout {
+			stale = append(stale, ms)
+			delete(c.peerSenders, p)
+		}
+	}
+	c.sendersLock.Unlock()
+
+	for _, ms := range stale {
+		ms.invalidate()
+	}
+}
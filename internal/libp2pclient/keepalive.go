@@ -0,0 +1,74 @@
+package libp2pclient
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	libp2pping "github.com/libp2p/go-libp2p/p2p/protocol/ping"
+)
+
+// errPingTimeout is returned by ping when the libp2p ping service doesn't
+// answer within the given timeout.
+var errPingTimeout = errors.New("ping timed out")
+
+// pingLoop sends a keepalive ping every pingInterval and records its RTT.
+// If maxMissed consecutive pings fail, the stream is considered dead and
+// invalidated, so the next SendRequest/SendMessage reopens it.
+func (ms *peerMessageSender) pingLoop(h host.Host, pingInterval time.Duration, maxMissed int, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	if pingInterval <= 0 {
+		<-stop
+		return
+	}
+
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := ms.ping(h, pingInterval); err != nil {
+				missed++
+				if missed >= maxMissed {
+					ms.invalidate()
+					return
+				}
+				continue
+			}
+			missed = 0
+		}
+	}
+}
+
+// ping performs a libp2p core /ipfs/ping/1.0.0 round trip to peerID and
+// records its RTT into the peer's metrics on success, separately from
+// AvgLatency: keepalive traffic runs on idle connections that have no real
+// requests in flight, so folding it into the same rolling window would skew
+// AvgLatency low regardless of actual request latency. It deliberately
+// doesn't go through this client's own request/response framing: this
+// package only defines the client side of its application protocol, with no
+// responder to echo an app-level ping back, so a keepalive built on it would
+// time out against every peer and evict every healthy connection. The
+// libp2p-wide ping protocol is answered by any host running the standard
+// ping service, which is on by default.
+func (ms *peerMessageSender) ping(h host.Host, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ms.clientCtx, timeout)
+	defer cancel()
+
+	res, ok := <-libp2pping.Ping(ctx, h, ms.peerID)
+	if !ok {
+		return errPingTimeout
+	}
+	if res.Error != nil {
+		return res.Error
+	}
+
+	ms.metrics.observePingRTT(res.RTT)
+	return nil
+}
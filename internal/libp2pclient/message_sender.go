@@ -0,0 +1,480 @@
+package libp2pclient
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"context"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/libp2p/go-msgio"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// reqHeaderLen is the size, in bytes, of the request-ID header that is
+// prepended to every message written on a stream. It lets a single reader
+// goroutine demultiplex responses to the waiter that is expecting them.
+const reqHeaderLen = 8
+
+// defaultPendingRequestCap bounds the number of in-flight requests a single
+// peerMessageSender will track at once, so a misbehaving or slow peer can't
+// make us grow the pending table without bound.
+const defaultPendingRequestCap = 256
+
+// ErrTooManyPendingRequests is returned by SendRequest when the pending
+// table for a peer is already at its cap.
+var ErrTooManyPendingRequests = errors.New("too many pending requests for peer")
+
+// pendingResponse is delivered to a waiting SendRequest call once its
+// response frame has been read off the stream, or once the stream/reader
+// gives up on it.
+type pendingResponse struct {
+	data []byte
+	err  error
+}
+
+// peerMessageSender owns the single stream used to talk to one peer, and
+// the bookkeeping needed to let multiple callers share it concurrently.
+type peerMessageSender struct {
+	peerID peer.ID
+
+	// ctxLock guards opening, tearing down, and replacing the stream.
+	ctxLock ctxMutex
+	// writeLock serializes writes onto the stream; it is separate from
+	// ctxLock so that a SendRequest waiting on a response doesn't block
+	// other callers from writing their own request.
+	writeLock sync.Mutex
+	// lifecycleLock guards invalid, closed, everPrepped, s, r, stopWrite,
+	// writeBuf, writeDirect, writerDone and readerDone against concurrent
+	// teardown() calls coming from the reader goroutine, the writer
+	// goroutine, and a caller's SendRequest/SendMessage all at once.
+	// teardown holds it for its entire body, including failing pending
+	// requests and queued writes, so a prep() reopening the stream can
+	// never interleave its own reinitialization of these fields with a
+	// still-running teardown of the old one; both take pendingLock as an
+	// inner lock when they touch pendingWaiters.
+	lifecycleLock sync.Mutex
+
+	s network.Stream
+	r msgio.ReadCloser
+
+	// protoLock guards proto, set once per successful stream negotiation.
+	protoLock sync.Mutex
+	proto     protocol.ID
+
+	// invalid is true whenever there is no live stream: before the first
+	// prep(), and again between a teardown() and whichever prep() call
+	// reopens the stream. It is cleared by prep() on success, so a sender
+	// is reused across reconnects rather than discarded.
+	invalid bool
+	// everPrepped is true once prep() has succeeded at least once, so a
+	// later successful prep() can tell a reconnect apart from the first
+	// connect for the Reconnects metric.
+	everPrepped bool
+	// closed is true once Client.Close has torn this sender down.
+	// Unlike invalid it is permanent: prep() refuses to reopen a stream
+	// for a closed sender.
+	closed bool
+
+	pendingRequestCap int
+	nextReqID         uint64
+
+	pendingLock    sync.Mutex
+	pendingWaiters map[uint64]chan *pendingResponse
+	readerDone     chan struct{}
+
+	// metrics is never nil: it is allocated once, when the
+	// peerMessageSender is created, so it keeps accumulating counters
+	// across stream reconnects.
+	metrics *PeerMetric
+	// limiter paces outgoing writes; nil means unlimited.
+	limiter *rate.Limiter
+
+	// writeBuf carries bulk traffic; writeDirect carries control/priority
+	// traffic (see SendPriorityMessage) and is always drained first by
+	// writeLoop so it can't be starved behind a backlog of bulk writes.
+	writeBuf    chan *writeJob
+	writeDirect chan *writeJob
+	stopWrite   chan struct{}
+	writerDone  chan struct{}
+
+	// group is the Client's errgroup: the reader and writer goroutines
+	// are spawned through it so Client.Close can wait for them to exit.
+	group *errgroup.Group
+	// clientCtx is the Client's background context; it is used to bound
+	// keepalive pings and is canceled by Client.Close.
+	clientCtx context.Context
+
+	// lastActivity is a UnixNano timestamp, updated on every successful
+	// read or write, that the idle reaper compares against IdleTimeout.
+	lastActivity int64
+
+	pingInterval   time.Duration
+	maxMissedPings int
+}
+
+// touch records that the stream was just used, for the idle reaper.
+func (ms *peerMessageSender) touch() {
+	atomic.StoreInt64(&ms.lastActivity, time.Now().UnixNano())
+}
+
+// idleFor returns how long it has been since the stream was last used.
+func (ms *peerMessageSender) idleFor() time.Duration {
+	last := atomic.LoadInt64(&ms.lastActivity)
+	if last == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, last))
+}
+
+// errStreamReset is delivered to pending requests and queued writes when
+// the stream to a peer breaks.
+var errStreamReset = errors.New("stream reset")
+
+// negotiatedProtocol returns the protocol.ID negotiated by the most recent
+// successful prep(), if any; teardown() does not clear it.
+func (ms *peerMessageSender) negotiatedProtocol() (protocol.ID, bool) {
+	ms.protoLock.Lock()
+	defer ms.protoLock.Unlock()
+	return ms.proto, ms.proto != ""
+}
+
+// invalidate tears down the stream after an error, so the next SendRequest
+// or SendMessage opens a fresh one.
+func (ms *peerMessageSender) invalidate() {
+	ms.teardown(errStreamReset, true)
+}
+
+// close tears down the stream for Client.Close: it lets anything already
+// queued finish writing, then closes the stream instead of resetting it so
+// the remote side sees a clean EOF rather than a reset. Unlike invalidate,
+// this is permanent: prep() will refuse to reopen the stream afterwards.
+func (ms *peerMessageSender) close(reason error) {
+	ms.drainWriteQueue(reason)
+
+	ms.lifecycleLock.Lock()
+	ms.closed = true
+	ms.lifecycleLock.Unlock()
+
+	ms.teardown(reason, false)
+}
+
+// teardown marks the message sender invalid and tears down its stream. If
+// reset is true the stream is reset (used on error paths); otherwise it is
+// closed gracefully (used by Client.Close). It is safe to call more than
+// once or concurrently from the reader goroutine, the writer goroutine, and
+// a caller's SendRequest/SendMessage.
+//
+// lifecycleLock is held for the whole call, including failing pending
+// requests and queued writes, not just the field updates: prep() takes the
+// same lock before reopening the stream, so it can never reinitialize
+// pendingWaiters/readerDone/writeBuf/stopWrite/writerDone while a teardown
+// of the previous stream is still in the middle of draining them.
+func (ms *peerMessageSender) teardown(reason error, reset bool) {
+	ms.lifecycleLock.Lock()
+	defer ms.lifecycleLock.Unlock()
+
+	if ms.invalid {
+		return
+	}
+	ms.invalid = true
+	if ms.s != nil {
+		if reset {
+			_ = ms.s.Reset()
+		} else {
+			// Close the write half so the remote sees a clean EOF, and
+			// explicitly close the read half too rather than relying on
+			// Close() alone: it only signals our intent to stop writing,
+			// and readLoop's blocked ReadMsg would otherwise keep
+			// waiting on the remote to close its own write side, which
+			// may never happen.
+			_ = ms.s.CloseWrite()
+			_ = ms.s.CloseRead()
+		}
+		ms.s = nil
+	}
+	if ms.stopWrite != nil {
+		close(ms.stopWrite)
+	}
+
+	ms.failAllPending(reason)
+	ms.failAllQueued(reason)
+}
+
+// failAllPending delivers err to every waiter currently registered, and
+// clears the pending table. Called whenever the reader goroutine exits,
+// whether because of a read error or because the sender was invalidated.
+func (ms *peerMessageSender) failAllPending(err error) {
+	ms.pendingLock.Lock()
+	waiters := ms.pendingWaiters
+	ms.pendingWaiters = make(map[uint64]chan *pendingResponse)
+	ms.pendingLock.Unlock()
+
+	for _, ch := range waiters {
+		ch <- &pendingResponse{err: err}
+	}
+}
+
+func (ms *peerMessageSender) prepOrInvalidate(ctx context.Context, h host.Host, protos []protocol.ID) error {
+	if err := ms.ctxLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer ms.ctxLock.Unlock()
+
+	if err := ms.prep(ctx, h, protos); err != nil {
+		ms.invalidate()
+		return err
+	}
+	return nil
+}
+
+func (ms *peerMessageSender) prep(ctx context.Context, h host.Host, protos []protocol.ID) error {
+	ms.lifecycleLock.Lock()
+	closed := ms.closed
+	s := ms.s
+	ms.lifecycleLock.Unlock()
+
+	if closed {
+		return errors.New("message sender has been closed")
+	}
+	if s != nil {
+		return nil
+	}
+
+	// protos is an ordered preference list (newest first); NewStream
+	// multistream-negotiates the first entry the remote also supports,
+	// falling back to an older one if that's all it advertises.
+	nstr, err := h.NewStream(ctx, ms.peerID, protos...)
+	if err != nil {
+		return err
+	}
+
+	ms.protoLock.Lock()
+	ms.proto = nstr.Protocol()
+	ms.protoLock.Unlock()
+
+	if ms.pendingRequestCap == 0 {
+		ms.pendingRequestCap = defaultPendingRequestCap
+	}
+
+	// Everything below is reinitializing per-connection state that the
+	// reader/writer goroutines and teardown() also touch. Do it all under
+	// one lifecycleLock section so a still-running teardown() of the
+	// previous stream (which holds the same lock for its own duration)
+	// can never interleave with this reopening it.
+	ms.lifecycleLock.Lock()
+	reconnect := ms.everPrepped
+	ms.everPrepped = true
+	ms.invalid = false
+	ms.r = msgio.NewVarintReaderSize(nstr, network.MessageSizeMax)
+	ms.s = nstr
+
+	ms.pendingLock.Lock()
+	ms.pendingWaiters = make(map[uint64]chan *pendingResponse)
+	ms.pendingLock.Unlock()
+
+	ms.readerDone = make(chan struct{})
+	ms.writeBuf = make(chan *writeJob, defaultWriteBufSize)
+	ms.writeDirect = make(chan *writeJob, defaultWriteDirectSize)
+	ms.stopWrite = make(chan struct{})
+	ms.writerDone = make(chan struct{})
+	r, readerDone := ms.r, ms.readerDone
+	writeBuf, writeDirect, stopWrite, writerDone := ms.writeBuf, ms.writeDirect, ms.stopWrite, ms.writerDone
+	ms.lifecycleLock.Unlock()
+
+	if reconnect {
+		ms.metrics.addReconnect()
+	}
+
+	ms.group.Go(func() error {
+		ms.readLoop(r, readerDone)
+		return nil
+	})
+	ms.group.Go(func() error {
+		ms.writeLoop(writeDirect, writeBuf, stopWrite, writerDone)
+		return nil
+	})
+
+	ms.touch()
+
+	pingDone := make(chan struct{})
+	ms.group.Go(func() error {
+		ms.pingLoop(h, ms.pingInterval, ms.maxMissedPings, stopWrite, pingDone)
+		return nil
+	})
+
+	return nil
+}
+
+// failAllQueued delivers err to every write job still sitting in either
+// write queue, so a caller blocked in enqueueWrite isn't left hanging when
+// the stream goes away.
+func (ms *peerMessageSender) failAllQueued(err error) {
+	for {
+		select {
+		case job := <-ms.writeDirect:
+			job.errCh <- err
+		default:
+			select {
+			case job := <-ms.writeBuf:
+				job.errCh <- err
+			default:
+				return
+			}
+		}
+	}
+}
+
+// readLoop is the single reader goroutine for this peer's stream. It reads
+// frames as they arrive and demuxes each one to the waiter registered under
+// its request ID, so that one slow or stuck response never blocks another
+// caller's SendRequest.
+func (ms *peerMessageSender) readLoop(r msgio.ReadCloser, done chan struct{}) {
+	defer close(done)
+
+	for {
+		frame, err := r.ReadMsg()
+		if err != nil {
+			// The reader goroutine is exiting either way: tear down the
+			// whole sender, not just the pending table, so the stream
+			// isn't left registered as usable. Otherwise writeFramed
+			// keeps happily writing into a connection nothing is
+			// reading from anymore until some other path notices.
+			ms.teardown(err, true)
+			return
+		}
+		if len(frame) < reqHeaderLen {
+			// Malformed frame; can't recover a request ID to
+			// deliver it, so drop it and keep reading.
+			continue
+		}
+
+		ms.metrics.addBytesRecv(len(frame))
+		ms.touch()
+
+		reqID := binary.BigEndian.Uint64(frame[:reqHeaderLen])
+		data := frame[reqHeaderLen:]
+
+		ms.pendingLock.Lock()
+		ch, ok := ms.pendingWaiters[reqID]
+		delete(ms.pendingWaiters, reqID)
+		ms.pendingLock.Unlock()
+
+		if ok {
+			ch <- &pendingResponse{data: data}
+		}
+		// No waiter registered (already timed out or canceled): drop
+		// the frame, there is nothing to deliver it to.
+	}
+}
+
+// sendMessage writes msg to the peer's stream without waiting for a
+// response. If direct is true, msg is sent on the priority queue ahead of
+// any bulk traffic already queued; see SendPriorityMessage.
+func (ms *peerMessageSender) sendMessage(ctx context.Context, msg proto.Message, h host.Host, protos []protocol.ID, direct bool) error {
+	if err := ms.ctxLock.Lock(ctx); err != nil {
+		return err
+	}
+	if err := ms.prep(ctx, h, protos); err != nil {
+		ms.invalidate()
+		ms.ctxLock.Unlock()
+		return err
+	}
+	ms.ctxLock.Unlock()
+
+	return ms.enqueueWrite(ctx, 0, msg, direct)
+}
+
+// sendRequest writes msg to the peer's stream and waits for the matching
+// response to be demuxed by the reader goroutine, without holding any lock
+// that would block other callers sharing the same peer.
+func (ms *peerMessageSender) sendRequest(ctx context.Context, msg proto.Message, decodeRsp DecodeResponseFunc, h host.Host, protos []protocol.ID) error {
+	if err := ms.ctxLock.Lock(ctx); err != nil {
+		return err
+	}
+	if err := ms.prep(ctx, h, protos); err != nil {
+		ms.invalidate()
+		ms.ctxLock.Unlock()
+		return err
+	}
+	ms.ctxLock.Unlock()
+
+	reqID := atomic.AddUint64(&ms.nextReqID, 1)
+	respCh := make(chan *pendingResponse, 1)
+
+	ms.pendingLock.Lock()
+	if len(ms.pendingWaiters) >= ms.pendingRequestCap {
+		ms.pendingLock.Unlock()
+		return ErrTooManyPendingRequests
+	}
+	ms.pendingWaiters[reqID] = respCh
+	ms.pendingLock.Unlock()
+
+	cleanup := func() {
+		ms.pendingLock.Lock()
+		delete(ms.pendingWaiters, reqID)
+		ms.pendingLock.Unlock()
+	}
+
+	start := time.Now()
+	ms.metrics.addRequestSent()
+	ms.metrics.incInflight()
+	defer ms.metrics.decInflight()
+
+	if err := ms.enqueueWrite(ctx, reqID, msg, false); err != nil {
+		cleanup()
+		return err
+	}
+
+	select {
+	case resp := <-respCh:
+		if resp.err != nil {
+			return resp.err
+		}
+		ms.metrics.observeLatency(time.Since(start))
+		return decodeRsp(resp.data)
+	case <-ctx.Done():
+		cleanup()
+		return ctx.Err()
+	}
+}
+
+// writeFramed marshals msg, prefixes it with reqID as an 8-byte big-endian
+// header, and writes the combined frame to the stream. Writes are
+// serialized with writeLock so concurrent callers sharing this
+// peerMessageSender don't interleave partial frames; the stream itself is
+// read out from under lifecycleLock since that's the only lock teardown and
+// prep use to touch s.
+func (ms *peerMessageSender) writeFramed(reqID uint64, msg proto.Message) error {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, reqHeaderLen+len(data))
+	binary.BigEndian.PutUint64(frame[:reqHeaderLen], reqID)
+	copy(frame[reqHeaderLen:], data)
+
+	ms.writeLock.Lock()
+	defer ms.writeLock.Unlock()
+
+	ms.lifecycleLock.Lock()
+	s := ms.s
+	ms.lifecycleLock.Unlock()
+
+	if s == nil {
+		return fmt.Errorf("no stream to write to")
+	}
+
+	return msgio.NewVarintWriter(s).WriteMsg(frame)
+}
@@ -0,0 +1,178 @@
+package libp2pclient
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// latencyWindowSize bounds the number of past request latencies kept per
+// peer for computing a rolling average.
+const latencyWindowSize = 64
+
+// PeerMetric tracks per-peer traffic and health counters. One is kept per
+// peerMessageSender and exposed read-only through Client.Stats() and,
+// if a registerer was supplied via PrometheusRegisterer, through
+// Prometheus.
+type PeerMetric struct {
+	bytesSent    uint64
+	bytesRecv    uint64
+	requestsSent uint64
+	errors       uint64
+	reconnects   uint64
+	inflight     int64
+
+	latencyLock sync.Mutex
+	latencies   [latencyWindowSize]time.Duration
+	latencyPos  int
+	latencyN    int
+
+	// pingRTT is the most recent keepalive ping RTT, in nanoseconds. It is
+	// tracked separately from latencies so an idle connection's keepalive
+	// traffic doesn't skew AvgLatency, which is meant to reflect real
+	// request/response latency.
+	pingRTT int64
+}
+
+func (m *PeerMetric) addBytesSent(n int) { atomic.AddUint64(&m.bytesSent, uint64(n)) }
+func (m *PeerMetric) addBytesRecv(n int) { atomic.AddUint64(&m.bytesRecv, uint64(n)) }
+func (m *PeerMetric) addRequestSent()    { atomic.AddUint64(&m.requestsSent, 1) }
+func (m *PeerMetric) addError()          { atomic.AddUint64(&m.errors, 1) }
+func (m *PeerMetric) addReconnect()      { atomic.AddUint64(&m.reconnects, 1) }
+func (m *PeerMetric) incInflight()       { atomic.AddInt64(&m.inflight, 1) }
+func (m *PeerMetric) decInflight()       { atomic.AddInt64(&m.inflight, -1) }
+
+// observeLatency records the round-trip latency of a completed request into
+// a fixed-size rolling window, used to compute PeerStats.AvgLatency.
+func (m *PeerMetric) observeLatency(d time.Duration) {
+	m.latencyLock.Lock()
+	defer m.latencyLock.Unlock()
+
+	m.latencies[m.latencyPos] = d
+	m.latencyPos = (m.latencyPos + 1) % latencyWindowSize
+	if m.latencyN < latencyWindowSize {
+		m.latencyN++
+	}
+}
+
+// observePingRTT records the round-trip latency of a keepalive ping,
+// exposed separately from AvgLatency through PeerStats.PingRTT.
+func (m *PeerMetric) observePingRTT(d time.Duration) {
+	atomic.StoreInt64(&m.pingRTT, int64(d))
+}
+
+func (m *PeerMetric) lastPingRTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&m.pingRTT))
+}
+
+func (m *PeerMetric) avgLatency() time.Duration {
+	m.latencyLock.Lock()
+	defer m.latencyLock.Unlock()
+
+	if m.latencyN == 0 {
+		return 0
+	}
+	var sum time.Duration
+	for i := 0; i < m.latencyN; i++ {
+		sum += m.latencies[i]
+	}
+	return sum / time.Duration(m.latencyN)
+}
+
+// PeerStats is a point-in-time snapshot of a peer's PeerMetric, returned by
+// Client.Stats().
+type PeerStats struct {
+	BytesSent    uint64
+	BytesRecv    uint64
+	RequestsSent uint64
+	Errors       uint64
+	Reconnects   uint64
+	Inflight     int64
+	AvgLatency   time.Duration
+	PingRTT      time.Duration
+}
+
+func (m *PeerMetric) snapshot() PeerStats {
+	return PeerStats{
+		BytesSent:    atomic.LoadUint64(&m.bytesSent),
+		BytesRecv:    atomic.LoadUint64(&m.bytesRecv),
+		RequestsSent: atomic.LoadUint64(&m.requestsSent),
+		Errors:       atomic.LoadUint64(&m.errors),
+		Reconnects:   atomic.LoadUint64(&m.reconnects),
+		Inflight:     atomic.LoadInt64(&m.inflight),
+		AvgLatency:   m.avgLatency(),
+		PingRTT:      m.lastPingRTT(),
+	}
+}
+
+// Stats returns a snapshot of the per-peer metrics for every peer this
+// Client currently has a message sender for.
+func (c *Client) Stats() map[peer.ID]PeerStats {
+	c.sendersLock.Lock()
+	defer c.sendersLock.Unlock()
+
+	out := make(map[peer.ID]PeerStats, len(c.peerSenders))
+	for p, ms := range c.peerSenders {
+		out[p] = ms.metrics.snapshot()
+	}
+	return out
+}
+
+// promCollector adapts a Client's per-peer Stats() snapshot to the
+// prometheus.Collector interface, so it can be registered with the
+// PrometheusRegisterer ClientOption instead of polled manually.
+type promCollector struct {
+	c *Client
+
+	bytesSent    *prometheus.Desc
+	bytesRecv    *prometheus.Desc
+	requestsSent *prometheus.Desc
+	errors       *prometheus.Desc
+	reconnects   *prometheus.Desc
+	inflight     *prometheus.Desc
+	avgLatency   *prometheus.Desc
+	pingRTT      *prometheus.Desc
+}
+
+func newPromCollector(c *Client) *promCollector {
+	labels := []string{"peer"}
+	return &promCollector{
+		c:            c,
+		bytesSent:    prometheus.NewDesc("libp2pclient_peer_bytes_sent", "Bytes sent to a peer.", labels, nil),
+		bytesRecv:    prometheus.NewDesc("libp2pclient_peer_bytes_recv", "Bytes received from a peer.", labels, nil),
+		requestsSent: prometheus.NewDesc("libp2pclient_peer_requests_sent", "Requests sent to a peer.", labels, nil),
+		errors:       prometheus.NewDesc("libp2pclient_peer_errors", "Errors encountered talking to a peer.", labels, nil),
+		reconnects:   prometheus.NewDesc("libp2pclient_peer_reconnects", "Times the stream to a peer was reopened.", labels, nil),
+		inflight:     prometheus.NewDesc("libp2pclient_peer_inflight_requests", "Requests currently awaiting a response from a peer.", labels, nil),
+		avgLatency:   prometheus.NewDesc("libp2pclient_peer_avg_latency_seconds", "Rolling average request latency to a peer.", labels, nil),
+		pingRTT:      prometheus.NewDesc("libp2pclient_peer_ping_rtt_seconds", "Most recent keepalive ping round-trip time to a peer.", labels, nil),
+	}
+}
+
+func (pc *promCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pc.bytesSent
+	ch <- pc.bytesRecv
+	ch <- pc.requestsSent
+	ch <- pc.errors
+	ch <- pc.reconnects
+	ch <- pc.inflight
+	ch <- pc.avgLatency
+	ch <- pc.pingRTT
+}
+
+func (pc *promCollector) Collect(ch chan<- prometheus.Metric) {
+	for p, s := range pc.c.Stats() {
+		label := p.String()
+		ch <- prometheus.MustNewConstMetric(pc.bytesSent, prometheus.CounterValue, float64(s.BytesSent), label)
+		ch <- prometheus.MustNewConstMetric(pc.bytesRecv, prometheus.CounterValue, float64(s.BytesRecv), label)
+		ch <- prometheus.MustNewConstMetric(pc.requestsSent, prometheus.CounterValue, float64(s.RequestsSent), label)
+		ch <- prometheus.MustNewConstMetric(pc.errors, prometheus.CounterValue, float64(s.Errors), label)
+		ch <- prometheus.MustNewConstMetric(pc.reconnects, prometheus.CounterValue, float64(s.Reconnects), label)
+		ch <- prometheus.MustNewConstMetric(pc.inflight, prometheus.GaugeValue, float64(s.Inflight), label)
+		ch <- prometheus.MustNewConstMetric(pc.avgLatency, prometheus.GaugeValue, s.AvgLatency.Seconds(), label)
+		ch <- prometheus.MustNewConstMetric(pc.pingRTT, prometheus.GaugeValue, s.PingRTT.Seconds(), label)
+	}
+}
@@ -0,0 +1,131 @@
+package libp2pclient
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Defaults for the keepalive/idle-reaping parameters, see PingInterval,
+// MaxMissedPings and IdleTimeout.
+const (
+	defaultPingInterval   = 30 * time.Second
+	defaultMaxMissedPings = 3
+	defaultIdleTimeout    = 10 * time.Minute
+)
+
+// clientConfig holds the configurable parameters of a Client, populated by
+// applying the ClientOptions passed into NewClient.
+type clientConfig struct {
+	pendingRequestCap int
+
+	// rateLimit and rateBurst configure the per-peer token-bucket rate
+	// limiter applied to outgoing writes. rateLimit <= 0 means no limit.
+	rateLimit float64
+	rateBurst int
+
+	registerer prometheus.Registerer
+
+	// pingInterval <= 0 disables keepalive pings.
+	pingInterval   time.Duration
+	maxMissedPings int
+	// idleTimeout <= 0 disables idle-stream reaping.
+	idleTimeout time.Duration
+}
+
+func (cfg *clientConfig) setDefaults() {
+	if cfg.pendingRequestCap == 0 {
+		cfg.pendingRequestCap = defaultPendingRequestCap
+	}
+	if cfg.pingInterval == 0 {
+		cfg.pingInterval = defaultPingInterval
+	}
+	if cfg.maxMissedPings == 0 {
+		cfg.maxMissedPings = defaultMaxMissedPings
+	}
+	if cfg.idleTimeout == 0 {
+		cfg.idleTimeout = defaultIdleTimeout
+	}
+}
+
+// ClientOption configures the libp2pclient Client created by NewClient.
+type ClientOption func(*clientConfig) error
+
+func (cfg *clientConfig) apply(opts ...ClientOption) error {
+	for i, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return fmt.Errorf("libp2pclient option %d failed: %w", i, err)
+		}
+	}
+	cfg.setDefaults()
+	return nil
+}
+
+// PendingRequestCap sets the maximum number of in-flight requests a single
+// peer connection will track at once. SendRequest returns
+// ErrTooManyPendingRequests once a peer is at its cap. The default is
+// defaultPendingRequestCap.
+func PendingRequestCap(n int) ClientOption {
+	return func(cfg *clientConfig) error {
+		cfg.pendingRequestCap = n
+		return nil
+	}
+}
+
+// RateLimit caps outgoing writes to a peer at rps messages per second, with
+// bursts of up to burst messages. It is applied per peer, before a message
+// is enqueued onto that peer's write queue. The default is unlimited.
+func RateLimit(rps float64, burst int) ClientOption {
+	return func(cfg *clientConfig) error {
+		cfg.rateLimit = rps
+		cfg.rateBurst = burst
+		return nil
+	}
+}
+
+// PrometheusRegisterer registers a collector exposing per-peer Stats() as
+// Prometheus metrics with reg.
+func PrometheusRegisterer(reg prometheus.Registerer) ClientOption {
+	return func(cfg *clientConfig) error {
+		cfg.registerer = reg
+		return nil
+	}
+}
+
+// PingInterval sets how often a keepalive ping is sent on an idle peer
+// connection. Pass a negative duration to disable keepalive pings
+// entirely. The default is defaultPingInterval.
+func PingInterval(d time.Duration) ClientOption {
+	return func(cfg *clientConfig) error {
+		if d < 0 {
+			d = -1
+		}
+		cfg.pingInterval = d
+		return nil
+	}
+}
+
+// MaxMissedPings sets how many consecutive keepalive pings a peer may miss
+// before its stream is considered dead and evicted, so the next
+// SendRequest/SendMessage reopens it. The default is defaultMaxMissedPings.
+func MaxMissedPings(n int) ClientOption {
+	return func(cfg *clientConfig) error {
+		cfg.maxMissedPings = n
+		return nil
+	}
+}
+
+// IdleTimeout sets how long a peer's stream may go untouched before the
+// background reaper closes it, so peerSenders doesn't grow unboundedly for
+// every peer ever contacted. Pass a negative duration to disable reaping.
+// The default is defaultIdleTimeout.
+func IdleTimeout(d time.Duration) ClientOption {
+	return func(cfg *clientConfig) error {
+		if d < 0 {
+			d = -1
+		}
+		cfg.idleTimeout = d
+		return nil
+	}
+}
@@ -0,0 +1,138 @@
+package libp2pclient
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+// defaultWriteBufSize and defaultWriteDirectSize bound the number of
+// queued-but-not-yet-written messages per peer, so a slow or stuck peer
+// can't make us buffer an unbounded amount of memory.
+const (
+	defaultWriteBufSize    = 64
+	defaultWriteDirectSize = 16
+)
+
+// ErrPeerQueueFull is returned by SendRequest/SendMessage when the peer's
+// write queue is already saturated, instead of blocking the caller
+// indefinitely.
+var ErrPeerQueueFull = errors.New("peer write queue is full")
+
+// writeJob is a single message waiting to be written to a peer's stream by
+// that peer's writeLoop.
+type writeJob struct {
+	reqID uint64
+	msg   proto.Message
+	errCh chan error
+}
+
+// enqueueWrite rate-limits the caller, then places a writeJob on the
+// priority (direct) or bulk write queue. It fails fast with
+// ErrPeerQueueFull rather than blocking forever if the chosen queue is
+// already full, and waits for the writeLoop to report the outcome of the
+// actual write.
+func (ms *peerMessageSender) enqueueWrite(ctx context.Context, reqID uint64, msg proto.Message, direct bool) error {
+	if ms.limiter != nil {
+		if err := ms.limiter.Wait(ctx); err != nil {
+			return err
+		}
+	}
+
+	job := &writeJob{reqID: reqID, msg: msg, errCh: make(chan error, 1)}
+
+	queue := ms.writeBuf
+	if direct {
+		queue = ms.writeDirect
+	}
+
+	select {
+	case queue <- job:
+	default:
+		return ErrPeerQueueFull
+	}
+
+	select {
+	case err := <-job.errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// writeLoop is the single background writer for a peer's stream. It always
+// drains writeDirect first so control/priority messages aren't stuck behind
+// a backlog of bulk writes.
+func (ms *peerMessageSender) writeLoop(writeDirect, writeBuf chan *writeJob, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	for {
+		job, ok := ms.nextWriteJob(writeDirect, writeBuf, stop)
+		if !ok {
+			return
+		}
+
+		err := ms.writeFramed(job.reqID, job.msg)
+		if err != nil {
+			ms.metrics.addError()
+		} else {
+			ms.metrics.addBytesSent(proto.Size(job.msg) + reqHeaderLen)
+			ms.touch()
+		}
+		job.errCh <- err
+
+		if err != nil {
+			ms.invalidate()
+			return
+		}
+	}
+}
+
+// nextWriteJob picks the next job to write, always preferring writeDirect
+// over writeBuf so a caller sharing this peer's queue can't starve control
+// traffic behind a backlog of bulk writes.
+func (ms *peerMessageSender) nextWriteJob(writeDirect, writeBuf chan *writeJob, stop chan struct{}) (*writeJob, bool) {
+	select {
+	case job := <-writeDirect:
+		return job, true
+	case <-stop:
+		return nil, false
+	default:
+	}
+
+	select {
+	case job := <-writeDirect:
+		return job, true
+	case job := <-writeBuf:
+		return job, true
+	case <-stop:
+		return nil, false
+	}
+}
+
+// drainWriteQueue writes out anything still sitting in the write queues
+// before the stream is torn down, so Client.Close flushes rather than drops
+// in-flight writes. Anything that still fails to write is handed reason
+// instead, same as failAllQueued would do.
+func (ms *peerMessageSender) drainWriteQueue(reason error) {
+	for {
+		var job *writeJob
+		select {
+		case job = <-ms.writeDirect:
+		default:
+			select {
+			case job = <-ms.writeBuf:
+			default:
+				return
+			}
+		}
+
+		if err := ms.writeFramed(job.reqID, job.msg); err != nil {
+			job.errCh <- reason
+			continue
+		}
+		ms.metrics.addBytesSent(proto.Size(job.msg) + reqHeaderLen)
+		job.errCh <- nil
+	}
+}
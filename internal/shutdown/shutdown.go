@@ -0,0 +1,45 @@
+// Package shutdown lets long-lived resources register themselves for a
+// bounded, graceful Close when the daemon is interrupted, without main
+// needing to import or know about every command's internals.
+package shutdown
+
+import (
+	"context"
+	"sync"
+)
+
+// Closer is anything that needs a bounded-context graceful shutdown call,
+// such as (*libp2pclient.Client).Close.
+type Closer interface {
+	Close(ctx context.Context) error
+}
+
+var (
+	mu      sync.Mutex
+	closers []Closer
+)
+
+// Register adds c to the set closed by CloseAll. A command constructs a
+// long-lived client (such as a libp2pclient.Client) and registers it here so
+// main's signal handler can shut it down gracefully on SIGINT/SIGTERM.
+func Register(c Closer) {
+	mu.Lock()
+	defer mu.Unlock()
+	closers = append(closers, c)
+}
+
+// CloseAll calls Close, bounded by ctx, on every Closer registered so far,
+// and returns the first error encountered.
+func CloseAll(ctx context.Context) error {
+	mu.Lock()
+	cs := append([]Closer(nil), closers...)
+	mu.Unlock()
+
+	var firstErr error
+	for _, c := range cs {
+		if err := c.Close(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -6,13 +6,20 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/filecoin-project/indexer-reference-provider/command"
+	"github.com/filecoin-project/indexer-reference-provider/internal/shutdown"
 	"github.com/filecoin-project/indexer-reference-provider/internal/version"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/urfave/cli/v2"
 )
 
+// shutdownTimeout bounds how long we wait for registered Closers (such as a
+// libp2pclient.Client) to drain on interrupt before giving up and letting
+// the process exit anyway.
+const shutdownTimeout = 10 * time.Second
+
 var log = logging.Logger("indexer-node")
 
 func main() {
@@ -26,9 +33,16 @@ func main() {
 		signal.Notify(interrupt, syscall.SIGTERM, syscall.SIGINT)
 		select {
 		case <-interrupt:
-			cancel()
 			fmt.Println("Received interrupt signal, shutting down...")
 			fmt.Println("(Hit ctrl-c again to force-shutdown the daemon.)")
+
+			shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			if err := shutdown.CloseAll(shutdownCtx); err != nil {
+				log.Errorw("error shutting down", "err", err)
+			}
+			shutdownCancel()
+
+			cancel()
 		case <-ctx.Done():
 		}
 		// Allow any forther SIGTERM or SIGING to kill process